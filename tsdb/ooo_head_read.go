@@ -1,9 +1,12 @@
 package tsdb
 
 import (
-	"math"
+	"fmt"
 	"sort"
+	"strings"
+	"sync"
 
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -21,15 +24,205 @@ var _ IndexReader = &OOOHeadIndexReader{}
 // The only methods that change are the ones about getting Series and Postings.
 type OOOHeadIndexReader struct {
 	*headIndexReader // A reference to the headIndexReader so we can reuse as many interface implementation as possible.
+	state            *oooQueryState
+	oooPostings      *oooPostings
 }
 
-func NewOOOHeadIndexReader(head *Head, mint, maxt int64) *OOOHeadIndexReader {
+// NewOOOHeadIndexReader constructs an OOOHeadIndexReader for one query.
+// oooPostings is the index of series with OOO data that Postings reads from
+// (see the oooPostings type below). It is supplied by the caller and holds
+// exactly the series recorded with its Add method and not since removed with
+// Del; Head holds no oooPostings, and neither the append path nor head
+// garbage collection calls Add or Del.
+func NewOOOHeadIndexReader(head *Head, mint, maxt int64, oooPostings *oooPostings) *OOOHeadIndexReader {
 	hr := &headIndexReader{
 		head: head,
 		mint: mint,
 		maxt: maxt,
 	}
-	return &OOOHeadIndexReader{hr}
+	return &OOOHeadIndexReader{hr, newOOOQueryState(), oooPostings}
+}
+
+// Note: chunks.Meta used to carry OOOLastRef/OOOLastMinTime/OOOLastMaxTime
+// fields that let a single Meta stand in for "the last of a run of chunks to
+// merge." Now that Series() records the full group in oooQueryState instead
+// (see multiMeta below), those fields are dead weight on chunks.Meta itself.
+// chunks.Meta is defined in tsdb/chunks, outside this file, so removing them
+// there is tracked separately; every write in this package has already
+// stopped populating them.
+
+// State returns the oooQueryState this reader's Series() calls populate.
+// A caller that needs both an OOOHeadIndexReader and an OOOHeadChunkReader
+// for the same query (e.g. to look up a series' chunks.Meta and then read
+// those chunks) must pass this same state into NewOOOHeadChunkReader, or the
+// chunk reader will recompute its own overlap groups and snapshots instead of
+// reusing the ones Series() already found.
+func (oh *OOOHeadIndexReader) State() *oooQueryState {
+	return oh.state
+}
+
+// multiMeta groups the set of overlapping OOO chunks that Series() decided
+// must be merged together to cover one output slot. OOOHeadChunkReader
+// looks the group up by Ref and merges every constituent in refs
+// deterministically, instead of re-scanning the series' oooMmappedChunks/
+// oooHeadChunk at read time and risking finding a different overlap set than
+// Series() did. refs is kept in append-recency order (oldest first), not
+// MinTime order, so the merge iterators' duplicate-timestamp tie-break and
+// counter-reset-at-chunk-boundary detection see the chunks in the order they
+// were actually written.
+type multiMeta struct {
+	MinTime, MaxTime int64
+	refs             []chunks.Meta
+}
+
+// oooQueryState is shared between the OOOHeadIndexReader and the
+// OOOHeadChunkReader created for the same query. Series() populates it while
+// holding the series lock: groups records which chunks.Meta refs must be
+// merged together, and snapshots holds a shallow copy of the samples in the
+// currently open (mutable) OOO head chunk, since it can keep changing after
+// Series() returns and before OOOHeadChunkReader.ChunkOrIterable runs.
+type oooQueryState struct {
+	mtx       sync.Mutex
+	groups    map[chunks.ChunkRef]*multiMeta
+	snapshots map[chunks.ChunkRef]chunkenc.Chunk
+}
+
+func newOOOQueryState() *oooQueryState {
+	return &oooQueryState{
+		groups:    make(map[chunks.ChunkRef]*multiMeta),
+		snapshots: make(map[chunks.ChunkRef]chunkenc.Chunk),
+	}
+}
+
+func (s *oooQueryState) newGroup(m chunks.Meta) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.groups[m.Ref] = &multiMeta{MinTime: m.MinTime, MaxTime: m.MaxTime, refs: []chunks.Meta{m}}
+}
+
+// sortGroupByRecency reorders a finished group's refs from the MinTime order
+// they were discovered in (needed to find the overlaps in the first place)
+// into append-recency order: ascending by the chunk ID embedded in each
+// chunks.ChunkRef, which increases with creation time regardless of the
+// sample MinTime a chunk happens to cover. oooMergedChunkIterator's
+// duplicate-timestamp tie-break and oooMergedHistogramIterator's
+// crossedChunk reset detection both assume the chunks they're handed are in
+// true append order, not MinTime order, which for out-of-order data are two
+// different axes.
+func (s *oooQueryState) sortGroupByRecency(groupRef chunks.ChunkRef) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	g := s.groups[groupRef]
+	sort.Slice(g.refs, func(i, j int) bool {
+		return chunkRecency(g.refs[i].Ref) < chunkRecency(g.refs[j].Ref)
+	})
+}
+
+// chunkRecency returns the chunk ID embedded in ref, which increases with
+// creation time and so orders chunks by append recency.
+func chunkRecency(ref chunks.ChunkRef) chunks.HeadChunkID {
+	_, cid := chunks.HeadChunkRef(ref).Unpack()
+	return cid
+}
+
+func (s *oooQueryState) addToGroup(groupRef chunks.ChunkRef, m chunks.Meta) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	g := s.groups[groupRef]
+	g.refs = append(g.refs, m)
+	if m.MaxTime > g.MaxTime {
+		g.MaxTime = m.MaxTime
+	}
+}
+
+func (s *oooQueryState) group(ref chunks.ChunkRef) (*multiMeta, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	g, ok := s.groups[ref]
+	return g, ok
+}
+
+func (s *oooQueryState) setSnapshot(ref chunks.ChunkRef, c chunkenc.Chunk) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.snapshots[ref] = c
+}
+
+func (s *oooQueryState) snapshot(ref chunks.ChunkRef) (chunkenc.Chunk, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	c, ok := s.snapshots[ref]
+	return c, ok
+}
+
+// snapshotChunk copies every sample in src into a freshly allocated chunk of
+// the same encoding, so that the result is safe to hand out even after src is
+// mutated or reused. It must stay encoding-aware: the OOO head chunk being
+// snapshotted can be a native histogram just as easily as a float chunk.
+func snapshotChunk(src chunkenc.Chunk) (chunkenc.Chunk, error) {
+	switch src.Encoding() {
+	case chunkenc.EncHistogram:
+		return snapshotHistogramChunk(src)
+	case chunkenc.EncFloatHistogram:
+		return snapshotFloatHistogramChunk(src)
+	default:
+		return snapshotFloatChunk(src)
+	}
+}
+
+func snapshotFloatChunk(src chunkenc.Chunk) (chunkenc.Chunk, error) {
+	dst := chunkenc.NewXORChunk()
+	app, err := dst.Appender()
+	if err != nil {
+		return nil, err
+	}
+	it := src.Iterator(nil)
+	for it.Next() != chunkenc.ValNone {
+		t, v := it.At()
+		app.Append(t, v)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+func snapshotHistogramChunk(src chunkenc.Chunk) (chunkenc.Chunk, error) {
+	dst := chunkenc.NewHistogramChunk()
+	app, err := dst.Appender()
+	if err != nil {
+		return nil, err
+	}
+	it := src.Iterator(nil)
+	for it.Next() != chunkenc.ValNone {
+		t, h := it.AtHistogram(nil)
+		if _, _, _, err := app.AppendHistogram(nil, t, h.Copy(), true); err != nil {
+			return nil, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+func snapshotFloatHistogramChunk(src chunkenc.Chunk) (chunkenc.Chunk, error) {
+	dst := chunkenc.NewFloatHistogramChunk()
+	app, err := dst.Appender()
+	if err != nil {
+		return nil, err
+	}
+	it := src.Iterator(nil)
+	for it.Next() != chunkenc.ValNone {
+		t, fh := it.AtFloatHistogram(nil)
+		if _, _, _, err := app.AppendFloatHistogram(nil, t, fh.Copy(), true); err != nil {
+			return nil, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return dst, nil
 }
 
 func (oh *OOOHeadIndexReader) Series(ref storage.SeriesRef, lbls *labels.Labels, chks *[]chunks.Meta) error {
@@ -51,40 +244,27 @@ func (oh *OOOHeadIndexReader) Series(ref storage.SeriesRef, lbls *labels.Labels,
 
 	tmpChks := make([]chunks.Meta, 0, len(s.oooMmappedChunks))
 
-	// We define these markers to track the last chunk reference while we
-	// fill the chunk meta.
-	// These markers are useful to give consistent responses to repeated queries
-	// even if new chunks that might be overlapping or not are added afterwards.
-	// Also, lastMinT and lastMaxT are initialized to the max int as a sentinel
-	// value to know they are unset.
-	var lastChunkRef chunks.ChunkRef
-	lastMinT, lastMaxT := int64(math.MaxInt64), int64(math.MaxInt64)
-
 	addChunk := func(minT, maxT int64, ref chunks.ChunkRef) {
-		// the first time we get called is for the last included chunk.
-		// set the markers accordingly
-		if lastMinT == int64(math.MaxInt64) {
-			lastChunkRef = ref
-			lastMinT = minT
-			lastMaxT = maxT
-		}
-
 		tmpChks = append(tmpChks, chunks.Meta{
-			MinTime:        minT,
-			MaxTime:        maxT,
-			Ref:            ref,
-			OOOLastRef:     lastChunkRef,
-			OOOLastMinTime: lastMinT,
-			OOOLastMaxTime: lastMaxT,
+			MinTime: minT,
+			MaxTime: maxT,
+			Ref:     ref,
 		})
 	}
 
-	// Collect all chunks that overlap the query range, in order from most recent to most old,
-	// so we can set the correct markers.
+	// Collect all chunks that overlap the query range, in order from most recent to most old.
 	if s.oooHeadChunk != nil {
 		c := s.oooHeadChunk
 		if c.OverlapsClosedInterval(oh.mint, oh.maxt) {
 			ref := chunks.ChunkRef(chunks.NewHeadChunkRef(s.ref, s.oooHeadChunkID(len(s.oooMmappedChunks))))
+			// The head chunk is still open for appends and can mutate after we
+			// release the series lock, so take a shallow copy of its samples now
+			// and stash it for OOOHeadChunkReader.Chunk to return later.
+			snap, err := snapshotChunk(c.chunk)
+			if err != nil {
+				return err
+			}
+			oh.state.setSnapshot(ref, snap)
 			addChunk(c.minTime, c.maxTime, ref)
 		}
 	}
@@ -110,17 +290,32 @@ func (oh *OOOHeadIndexReader) Series(ref storage.SeriesRef, lbls *labels.Labels,
 	// Example chunks of a series: 5:(100, 200) 6:(500, 600) 7:(150, 250) 8:(550, 650)
 	// In the example 5 overlaps with 7 and 6 overlaps with 8 so we only want to
 	// to return chunk Metas for chunk 5 and chunk 6
+	// Every group of chunks collapsed into one output slot is also recorded
+	// in oh.state, keyed by the Ref of the first (outer) chunk in the group,
+	// so OOOHeadChunkReader can later merge every constituent deterministically.
+	// Groups are discovered in MinTime order (needed to find the overlaps),
+	// but sortGroupByRecency re-orders each one into append order once it's
+	// complete, since that's the order the merge iterators actually need.
 	*chks = append(*chks, tmpChks[0])
+	groupRef := tmpChks[0].Ref
+	oh.state.newGroup(tmpChks[0])
 	maxTime := tmpChks[0].MaxTime // tracks the maxTime of the previous "to be merged chunk"
 	for _, c := range tmpChks[1:] {
 		if c.MinTime > maxTime {
+			oh.state.sortGroupByRecency(groupRef)
 			*chks = append(*chks, c)
+			groupRef = c.Ref
+			oh.state.newGroup(c)
 			maxTime = c.MaxTime
-		} else if c.MaxTime > maxTime {
-			maxTime = c.MaxTime
-			(*chks)[len(*chks)-1].MaxTime = c.MaxTime
+		} else {
+			oh.state.addToGroup(groupRef, c)
+			if c.MaxTime > maxTime {
+				maxTime = c.MaxTime
+				(*chks)[len(*chks)-1].MaxTime = c.MaxTime
+			}
 		}
 	}
+	oh.state.sortGroupByRecency(groupRef)
 
 	return nil
 }
@@ -131,36 +326,258 @@ func (b byMinTime) Len() int           { return len(b) }
 func (b byMinTime) Less(i, j int) bool { return b[i].MinTime < b[j].MinTime }
 func (b byMinTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
 
+// Postings returns only the series that oh.oooPostings lists for the given
+// label name and value(s), rather than every series in head.postings matching
+// them. Which series are listed depends entirely on the Add and Del calls made
+// on that oooPostings; it is not updated by the head itself.
 func (oh *OOOHeadIndexReader) Postings(name string, values ...string) (index.Postings, error) {
 	switch len(values) {
 	case 0:
 		return index.EmptyPostings(), nil
 	case 1:
-		return oh.head.postings.Get(name, values[0]), nil // TODO(ganesh) Also call GetOOOPostings
+		return oh.oooPostings.Get(name, values[0]), nil
 	default:
-		// TODO(ganesh) We want to only return postings for out of order series.
 		res := make([]index.Postings, 0, len(values))
 		for _, value := range values {
-			res = append(res, oh.head.postings.Get(name, value)) // TODO(ganesh) Also call GetOOOPostings
+			res = append(res, oh.oooPostings.Get(name, value))
 		}
 		return index.Merge(res...), nil
 	}
 }
 
+// oooPostings is a postings index of series that currently have
+// out-of-order data, kept separately from the regular head.postings index.
+// A series is listed from the Add call that records it until the Del call
+// that removes it. Head holds no oooPostings and neither its append path nor
+// its garbage collection calls Add or Del; the instance passed to
+// NewOOOHeadIndexReader is updated only by whoever holds it.
+type oooPostings struct {
+	mtx    sync.Mutex
+	series map[string]map[storage.SeriesRef]struct{} // "name=value" -> series refs with OOO data.
+}
+
+func newOOOPostings() *oooPostings {
+	return &oooPostings{series: make(map[string]map[storage.SeriesRef]struct{})}
+}
+
+func oooPostingsKey(name, value string) string {
+	return name + "=" + value
+}
+
+// Add records that ref, with label set lbls, currently has OOO data.
+func (p *oooPostings) Add(ref storage.SeriesRef, lbls labels.Labels) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	lbls.Range(func(l labels.Label) {
+		key := oooPostingsKey(l.Name, l.Value)
+		set, ok := p.series[key]
+		if !ok {
+			set = make(map[storage.SeriesRef]struct{})
+			p.series[key] = set
+		}
+		set[ref] = struct{}{}
+	})
+}
+
+// Del removes ref, e.g. once its OOO chunks have all been mmapped-out or
+// garbage collected.
+func (p *oooPostings) Del(ref storage.SeriesRef, lbls labels.Labels) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	lbls.Range(func(l labels.Label) {
+		key := oooPostingsKey(l.Name, l.Value)
+		set, ok := p.series[key]
+		if !ok {
+			return
+		}
+		delete(set, ref)
+		if len(set) == 0 {
+			delete(p.series, key)
+		}
+	})
+}
+
+// Get returns the series with OOO data for name=value, in the ascending ref
+// order index.Postings implementations are expected to produce.
+func (p *oooPostings) Get(name, value string) index.Postings {
+	p.mtx.Lock()
+	set := p.series[oooPostingsKey(name, value)]
+	refs := make([]storage.SeriesRef, 0, len(set))
+	for ref := range set {
+		refs = append(refs, ref)
+	}
+	p.mtx.Unlock()
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	return index.NewListPostings(refs)
+}
+
+// LabelValuesFor is the OOO-only counterpart to
+// index.MemPostings.LabelValuesFor: it returns every value of name among the
+// series in postings that currently have OOO data.
+func (p *oooPostings) LabelValuesFor(postings index.Postings, name string) []string {
+	have := make(map[storage.SeriesRef]struct{})
+	for postings.Next() {
+		have[postings.At()] = struct{}{}
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	prefix := name + "="
+	var values []string
+	for key, set := range p.series {
+		value, ok := strings.CutPrefix(key, prefix)
+		if !ok {
+			continue
+		}
+		for ref := range set {
+			if _, ok := have[ref]; ok {
+				values = append(values, value)
+				break
+			}
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+// PostingsForLabelMatching is the OOO-only counterpart to
+// index.MemPostings.PostingsForLabelMatching: it returns the series with OOO
+// data whose value for name satisfies match.
+func (p *oooPostings) PostingsForLabelMatching(name string, match func(string) bool) index.Postings {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	prefix := name + "="
+	var all []index.Postings
+	for key, set := range p.series {
+		value, ok := strings.CutPrefix(key, prefix)
+		if !ok || !match(value) {
+			continue
+		}
+		refs := make([]storage.SeriesRef, 0, len(set))
+		for ref := range set {
+			refs = append(refs, ref)
+		}
+		sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+		all = append(all, index.NewListPostings(refs))
+	}
+	return index.Merge(all...)
+}
+
 type OOOHeadChunkReader struct {
 	head       *Head
 	mint, maxt int64
+	state      *oooQueryState
 }
 
-func NewOOOHeadChunkReader(head *Head, mint, maxt int64) *OOOHeadChunkReader {
+func NewOOOHeadChunkReader(head *Head, mint, maxt int64, state *oooQueryState) *OOOHeadChunkReader {
 	return &OOOHeadChunkReader{
-		head: head,
-		mint: mint,
-		maxt: maxt,
+		head:  head,
+		mint:  mint,
+		maxt:  maxt,
+		state: state,
 	}
 }
 
+// Chunk is a thin wrapper around ChunkOrIterable for callers that have not
+// been migrated to the iterable-aware path yet. It materializes an Iterable
+// result into a single chunk, which is only valid for a float merge: a
+// native histogram merge may need to be split at a counter reset, a decision
+// that belongs to SplitAtCounterResets, not to this method, so it returns an
+// error instead of silently materializing a chunk that skips that split.
 func (cr OOOHeadChunkReader) Chunk(ref chunks.ChunkRef) (chunkenc.Chunk, error) {
+	c, it, err := cr.ChunkOrIterable(chunks.Meta{Ref: ref})
+	if err != nil {
+		return nil, err
+	}
+	if c != nil {
+		return c, nil
+	}
+	if _, ok := it.(*oooMergedHistogramChunk); ok {
+		return nil, fmt.Errorf("cannot materialize a merged OOO native histogram range into a single chunk, use ChunkOrIterable and SplitAtCounterResets instead")
+	}
+	return materializeIterable(it)
+}
+
+// ChunkOrIterable returns either a single chunk for the given meta, or an
+// Iterable when the underlying data has to be assembled from more than one
+// OOO chunk. Returning an Iterable lets the caller decide how to slice the
+// merged samples into output chunks instead of forcing that decision here.
+//
+// meta.Ref is looked up in the group recorded by Series() for this query, so
+// the set of chunks being merged here is exactly the set Series() decided
+// overlapped -- there is no second, possibly different, overlap computation.
+func (cr OOOHeadChunkReader) ChunkOrIterable(meta chunks.Meta) (chunkenc.Chunk, chunkenc.Iterable, error) {
+	refs := []chunks.ChunkRef{meta.Ref}
+	if cr.state != nil {
+		if g, ok := cr.state.group(meta.Ref); ok {
+			refs = make([]chunks.ChunkRef, 0, len(g.refs))
+			for _, sub := range g.refs {
+				refs = append(refs, sub.Ref)
+			}
+		}
+	}
+
+	if len(refs) == 1 {
+		c, err := cr.readChunk(refs[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		wrapped, err := wrapOOOHeadChunk(c)
+		return wrapped, nil, err
+	}
+
+	chks := make([]chunkenc.Chunk, 0, len(refs))
+	for _, ref := range refs {
+		c, err := cr.readChunk(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		chks = append(chks, c)
+	}
+
+	switch enc := chks[0].Encoding(); enc {
+	case chunkenc.EncXOR:
+		for _, c := range chks[1:] {
+			if c.Encoding() != chunkenc.EncXOR {
+				return nil, nil, fmt.Errorf("cannot merge overlapping OOO chunks with different encodings %s and %s", enc, c.Encoding())
+			}
+		}
+		it, err := wrapOOOMergedChunk(&oooMergedChunk{chunks: chks})
+		return nil, it, err
+	case chunkenc.EncHistogram, chunkenc.EncFloatHistogram:
+		// A single OOO query range may now span a native histogram counter
+		// reset once histograms can be written out of order, so we can't
+		// collapse the merge into one chunk here the way the float case
+		// does: the caller has to slice at each reset (see
+		// SplitAtCounterResets), which is why this branch always returns an
+		// Iterable rather than a materialized chunk.
+		for i, c := range chks {
+			cp, err := wrapOOOHeadChunk(c)
+			if err != nil {
+				return nil, nil, err
+			}
+			chks[i] = cp
+		}
+		merged, err := newOOOMergedHistogramChunk(chks)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, merged, nil
+	default:
+		return nil, nil, fmt.Errorf("cannot merge overlapping OOO chunks with unsupported encoding %s", enc)
+	}
+}
+
+// readChunk returns the single chunk addressed by ref, either from the
+// per-query snapshot taken by Series() (if ref points at the mutable head
+// chunk) or by reading it straight off the series/disk mapper.
+func (cr OOOHeadChunkReader) readChunk(ref chunks.ChunkRef) (chunkenc.Chunk, error) {
+	if cr.state != nil {
+		if c, ok := cr.state.snapshot(ref); ok {
+			return c, nil
+		}
+	}
+
 	sid, cid := chunks.HeadChunkRef(ref).Unpack()
 
 	s := cr.head.series.getByID(sid)
@@ -170,7 +587,7 @@ func (cr OOOHeadChunkReader) Chunk(ref chunks.ChunkRef) (chunkenc.Chunk, error)
 	}
 
 	s.Lock()
-	c, garbageCollect, err := s.ooochunk(cid, cr.head.chunkDiskMapper) // TODO(jesus.vazquez) here is where we do the magic of merging overlapping chunks
+	c, garbageCollect, err := s.ooochunk(cid, cr.head.chunkDiskMapper)
 	if err != nil {
 		s.Unlock()
 		return nil, err
@@ -183,7 +600,6 @@ func (cr OOOHeadChunkReader) Chunk(ref chunks.ChunkRef) (chunkenc.Chunk, error)
 		}
 	}()
 
-	// TODO(jesus.vazquez) I wonder if this check should be run here
 	// This means that the chunk is outside the specified range.
 	if !c.OverlapsClosedInterval(cr.mint, cr.maxt) {
 		s.Unlock()
@@ -202,3 +618,469 @@ func (cr OOOHeadChunkReader) Chunk(ref chunks.ChunkRef) (chunkenc.Chunk, error)
 func (cr OOOHeadChunkReader) Close() error {
 	return nil
 }
+
+// wrapOOOHeadChunk returns c wrapped in a private copy of its samples, so
+// that a chunkenc.Pool.Put on the chunk backing c -- e.g. a compactor
+// recycling chunk objects concurrently with this query -- cannot corrupt the
+// query's view of the data. safeChunk already guards the mmapped-file case
+// (the disk mapper ref stays valid), but does nothing to stop the in-memory
+// chunk object itself from being reset and handed to someone else, so every
+// chunk leaving OOOHeadChunkReader is copied here regardless of where it
+// came from. snapshotChunk is encoding-aware, so this works for native
+// histogram chunks exactly as it does for float chunks.
+func wrapOOOHeadChunk(c chunkenc.Chunk) (chunkenc.Chunk, error) {
+	cp, err := snapshotChunk(c)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// wrapOOOMergedChunk materializes m's merged samples into a single private
+// chunk and returns it as a chunkenc.Iterable, for the same reason
+// wrapOOOHeadChunk exists: none of m's constituent chunks may still be valid
+// by the time the caller gets around to iterating the result.
+func wrapOOOMergedChunk(m *oooMergedChunk) (chunkenc.Iterable, error) {
+	c, err := materializeIterable(m)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// materializeIterable drains it into a single in-memory XOR chunk, so it only
+// handles float samples. It is used by wrapOOOMergedChunk for float merges and
+// by the legacy Chunk() path; histogram merges are not passed through it.
+func materializeIterable(it chunkenc.Iterable) (chunkenc.Chunk, error) {
+	out := chunkenc.NewXORChunk()
+	app, err := out.Appender()
+	if err != nil {
+		return nil, err
+	}
+	sit := it.Iterator(nil)
+	for sit.Next() != chunkenc.ValNone {
+		t, v := sit.At()
+		app.Append(t, v)
+	}
+	if err := sit.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// oooMergedChunk represents a set of overlapping out-of-order chunks that
+// must be iterated together, in time order, to reconstruct the samples for a
+// query range. It satisfies chunkenc.Iterable rather than the full
+// chunkenc.Chunk interface. It only merges float (XOR) chunks; merged native
+// histogram ranges, which may need to be split at a counter reset, are
+// handled by oooMergedHistogramChunk instead.
+type oooMergedChunk struct {
+	chunks []chunkenc.Chunk
+}
+
+func (o *oooMergedChunk) Iterator(chunkenc.Iterator) chunkenc.Iterator {
+	iterators := make([]chunkenc.Iterator, 0, len(o.chunks))
+	for _, c := range o.chunks {
+		iterators = append(iterators, c.Iterator(nil))
+	}
+	return newOOOMergedChunkIterator(iterators)
+}
+
+// oooMergedChunkIterator does a k-way merge of the samples in a set of
+// overlapping OOO chunks, in ascending time order. When two constituent
+// chunks have a sample at the same timestamp, the sample belonging to the
+// later chunk in iterators (the one appended most recently) wins, matching
+// how the OOO head resolves duplicate timestamps on ingest.
+type oooMergedChunkIterator struct {
+	iterators []chunkenc.Iterator
+	heads     []bool // heads[i] reports whether iterators[i] has a pending sample buffered.
+
+	curT int64
+	curV float64
+	err  error
+}
+
+func newOOOMergedChunkIterator(iterators []chunkenc.Iterator) *oooMergedChunkIterator {
+	return &oooMergedChunkIterator{
+		iterators: iterators,
+		heads:     make([]bool, len(iterators)),
+	}
+}
+
+func (o *oooMergedChunkIterator) Next() chunkenc.ValueType {
+	// Prime every iterator that doesn't already have a buffered sample.
+	for i, it := range o.iterators {
+		if !o.heads[i] {
+			o.heads[i] = it.Next() != chunkenc.ValNone
+		}
+	}
+
+	// Pick the smallest timestamp across all buffered samples; on ties,
+	// prefer the iterator with the highest index so later-appended chunks
+	// win, and consume (but discard) the losing duplicate.
+	minT := int64(0)
+	minI := -1
+	for i, ok := range o.heads {
+		if !ok {
+			continue
+		}
+		t := o.iterators[i].AtT()
+		if minI == -1 || t <= minT {
+			minT, minI = t, i
+		}
+	}
+	if minI == -1 {
+		return chunkenc.ValNone
+	}
+
+	// Drain any other iterator sitting on the same timestamp so it isn't
+	// returned again on a later call.
+	for i, ok := range o.heads {
+		if !ok || i == minI {
+			continue
+		}
+		if o.iterators[i].AtT() == minT {
+			o.heads[i] = o.iterators[i].Next() != chunkenc.ValNone
+		}
+	}
+
+	o.curT, o.curV = o.iterators[minI].At()
+	o.heads[minI] = o.iterators[minI].Next() != chunkenc.ValNone
+	return chunkenc.ValFloat
+}
+
+func (o *oooMergedChunkIterator) Seek(t int64) chunkenc.ValueType {
+	for o.curT < t {
+		if o.Next() == chunkenc.ValNone {
+			return chunkenc.ValNone
+		}
+	}
+	return chunkenc.ValFloat
+}
+
+func (o *oooMergedChunkIterator) At() (int64, float64) {
+	return o.curT, o.curV
+}
+
+// AtHistogram and AtFloatHistogram are not yet supported: OOO native
+// histograms are handled by oooMergedHistogramIterator instead (see the
+// counter-reset splitting added on top of ChunkOrIterable).
+func (o *oooMergedChunkIterator) AtHistogram(*histogram.Histogram) (int64, *histogram.Histogram) {
+	panic("oooMergedChunkIterator: histogram samples not supported")
+}
+
+func (o *oooMergedChunkIterator) AtFloatHistogram(*histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	panic("oooMergedChunkIterator: float histogram samples not supported")
+}
+
+func (o *oooMergedChunkIterator) AtT() int64 {
+	return o.curT
+}
+
+func (o *oooMergedChunkIterator) Err() error {
+	for _, it := range o.iterators {
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return o.err
+}
+
+// oooMergedHistogramChunk is the native-histogram counterpart to
+// oooMergedChunk. It satisfies chunkenc.Iterable, never chunkenc.Chunk: a
+// merged OOO histogram range may contain a counter reset at the boundary
+// between two constituent chunks, and splitting at that boundary is the
+// caller's job (see SplitAtCounterResets), not something a single Chunk can
+// represent.
+type oooMergedHistogramChunk struct {
+	chunks   []chunkenc.Chunk
+	encoding chunkenc.Encoding // EncHistogram or EncFloatHistogram; validated to be uniform across chunks.
+}
+
+// newOOOMergedHistogramChunk validates that every chunk shares the same
+// histogram encoding -- mixing EncHistogram and EncFloatHistogram samples
+// within one merged range isn't supported -- and returns the merged chunk.
+func newOOOMergedHistogramChunk(chks []chunkenc.Chunk) (*oooMergedHistogramChunk, error) {
+	if len(chks) == 0 {
+		return &oooMergedHistogramChunk{}, nil
+	}
+	enc := chks[0].Encoding()
+	for _, c := range chks[1:] {
+		if c.Encoding() != enc {
+			return nil, fmt.Errorf("cannot merge OOO chunks with different histogram encodings %s and %s", enc, c.Encoding())
+		}
+	}
+	return &oooMergedHistogramChunk{chunks: chks, encoding: enc}, nil
+}
+
+func (o *oooMergedHistogramChunk) Iterator(chunkenc.Iterator) chunkenc.Iterator {
+	iterators := make([]chunkenc.Iterator, 0, len(o.chunks))
+	for _, c := range o.chunks {
+		iterators = append(iterators, c.Iterator(nil))
+	}
+	return newOOOMergedHistogramIterator(o.encoding, iterators)
+}
+
+// oooMergedHistogramIterator k-way merges the samples of a set of
+// overlapping OOO histogram chunks in time order, the same way
+// oooMergedChunkIterator does for floats, but additionally detects counter
+// resets: when a sample comes from a different constituent chunk than the
+// previous one, or already carries an explicit reset hint, and
+// histogramCounterReset (or floatHistogramCounterReset) reports a reset
+// relative to the previous sample, the returned histogram is tagged with
+// histogram.CounterReset so SplitAtCounterResets knows to start a new
+// output chunk there. Samples following one another within the same chunk
+// are not compared.
+type oooMergedHistogramIterator struct {
+	encoding  chunkenc.Encoding
+	iterators []chunkenc.Iterator
+	heads     []bool
+
+	curT  int64
+	curH  *histogram.Histogram
+	curFH *histogram.FloatHistogram
+
+	prevH        *histogram.Histogram
+	prevFH       *histogram.FloatHistogram
+	prevChunkIdx int
+
+	err error
+}
+
+func newOOOMergedHistogramIterator(enc chunkenc.Encoding, iterators []chunkenc.Iterator) *oooMergedHistogramIterator {
+	return &oooMergedHistogramIterator{
+		encoding:     enc,
+		iterators:    iterators,
+		heads:        make([]bool, len(iterators)),
+		prevChunkIdx: -1,
+	}
+}
+
+func (o *oooMergedHistogramIterator) valueType() chunkenc.ValueType {
+	if o.encoding == chunkenc.EncFloatHistogram {
+		return chunkenc.ValFloatHistogram
+	}
+	return chunkenc.ValHistogram
+}
+
+func (o *oooMergedHistogramIterator) Next() chunkenc.ValueType {
+	for i, it := range o.iterators {
+		if !o.heads[i] {
+			o.heads[i] = it.Next() != chunkenc.ValNone
+		}
+	}
+
+	minT := int64(0)
+	minI := -1
+	for i, ok := range o.heads {
+		if !ok {
+			continue
+		}
+		t := o.iterators[i].AtT()
+		if minI == -1 || t <= minT {
+			minT, minI = t, i
+		}
+	}
+	if minI == -1 {
+		return chunkenc.ValNone
+	}
+
+	for i, ok := range o.heads {
+		if !ok || i == minI {
+			continue
+		}
+		if o.iterators[i].AtT() == minT {
+			o.heads[i] = o.iterators[i].Next() != chunkenc.ValNone
+		}
+	}
+
+	crossedChunk := minI != o.prevChunkIdx && o.prevChunkIdx != -1
+	o.prevChunkIdx = minI
+
+	if o.encoding == chunkenc.EncFloatHistogram {
+		t, fh := o.iterators[minI].AtFloatHistogram(nil)
+		fh = fh.Copy()
+		if o.prevFH != nil && (crossedChunk || fh.CounterResetHint == histogram.CounterReset) && floatHistogramCounterReset(o.prevFH, fh) {
+			fh.CounterResetHint = histogram.CounterReset
+		}
+		o.curT, o.curFH = t, fh
+		o.prevFH = fh
+	} else {
+		t, h := o.iterators[minI].AtHistogram(nil)
+		h = h.Copy()
+		if o.prevH != nil && (crossedChunk || h.CounterResetHint == histogram.CounterReset) && histogramCounterReset(o.prevH, h) {
+			h.CounterResetHint = histogram.CounterReset
+		}
+		o.curT, o.curH = t, h
+		o.prevH = h
+	}
+
+	o.heads[minI] = o.iterators[minI].Next() != chunkenc.ValNone
+	return o.valueType()
+}
+
+// histogramCounterReset reports whether cur looks like a counter reset
+// relative to prev: either cur already carries an explicit reset hint, or
+// its total observation count, zero-bucket count, or any individual bucket
+// count went down, none of which is possible for a counter-like histogram
+// that hasn't been reset.
+func histogramCounterReset(prev, cur *histogram.Histogram) bool {
+	if cur.CounterResetHint == histogram.CounterReset {
+		return true
+	}
+	if cur.Count < prev.Count || cur.ZeroCount < prev.ZeroCount {
+		return true
+	}
+	return bucketCountsDecreased(prev.PositiveBuckets, cur.PositiveBuckets) ||
+		bucketCountsDecreased(prev.NegativeBuckets, cur.NegativeBuckets)
+}
+
+func floatHistogramCounterReset(prev, cur *histogram.FloatHistogram) bool {
+	if cur.CounterResetHint == histogram.CounterReset {
+		return true
+	}
+	if cur.Count < prev.Count || cur.ZeroCount < prev.ZeroCount {
+		return true
+	}
+	return floatBucketCountsDecreased(prev.PositiveBuckets, cur.PositiveBuckets) ||
+		floatBucketCountsDecreased(prev.NegativeBuckets, cur.NegativeBuckets)
+}
+
+// bucketCountsDecreased reports whether any index-aligned *absolute*
+// bucket count went down between prev and cur. Unlike FloatHistogram,
+// histogram.Histogram's PositiveBuckets/NegativeBuckets are delta-encoded --
+// each entry is relative to the previous bucket, not an absolute count -- so
+// comparing the raw deltas index-by-index is not equivalent to comparing the
+// actual per-bucket observation counts a redistribution between adjacent
+// buckets can shrink one delta while leaving every real bucket count
+// unchanged or higher. Reconstruct the running total with a prefix sum
+// before comparing, matching the real appender's reset-detection logic.
+// Buckets are compared by position only; a genuine layout change (span
+// insertion/removal) is out of scope here and is expected to carry its own
+// explicit CounterResetHint from the appender.
+func bucketCountsDecreased(prev, cur []int64) bool {
+	var prevCum, curCum int64
+	for i := 0; i < len(prev) && i < len(cur); i++ {
+		prevCum += prev[i]
+		curCum += cur[i]
+		if curCum < prevCum {
+			return true
+		}
+	}
+	return false
+}
+
+// floatBucketCountsDecreased compares FloatHistogram buckets directly, since
+// those are already absolute per-bucket counts rather than deltas.
+func floatBucketCountsDecreased(prev, cur []float64) bool {
+	for i := 0; i < len(prev) && i < len(cur); i++ {
+		if cur[i] < prev[i] {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *oooMergedHistogramIterator) Seek(t int64) chunkenc.ValueType {
+	for o.curT < t {
+		if o.Next() == chunkenc.ValNone {
+			return chunkenc.ValNone
+		}
+	}
+	return o.valueType()
+}
+
+func (o *oooMergedHistogramIterator) At() (int64, float64) {
+	panic("oooMergedHistogramIterator: float samples not supported")
+}
+
+func (o *oooMergedHistogramIterator) AtHistogram(*histogram.Histogram) (int64, *histogram.Histogram) {
+	return o.curT, o.curH
+}
+
+func (o *oooMergedHistogramIterator) AtFloatHistogram(*histogram.FloatHistogram) (int64, *histogram.FloatHistogram) {
+	return o.curT, o.curFH
+}
+
+func (o *oooMergedHistogramIterator) AtT() int64 {
+	return o.curT
+}
+
+func (o *oooMergedHistogramIterator) Err() error {
+	for _, it := range o.iterators {
+		if err := it.Err(); err != nil {
+			return err
+		}
+	}
+	return o.err
+}
+
+// SplitAtCounterResets drains it, an iterator over a native-histogram
+// Iterable produced by OOOHeadChunkReader.ChunkOrIterable, into one or more
+// chunks.Meta, starting
+// a new output chunk every time it hands back a sample tagged with
+// histogram.CounterReset. baseRef is only used to give each returned Meta a
+// distinct Ref; callers that need a durable on-disk ref must remap it.
+func SplitAtCounterResets(baseRef chunks.ChunkRef, it chunkenc.Iterator) ([]chunks.Meta, error) {
+	var (
+		metas      []chunks.Meta
+		cur        chunkenc.Chunk
+		app        chunkenc.Appender
+		minT, maxT int64
+	)
+
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		metas = append(metas, chunks.Meta{
+			Chunk:   cur,
+			MinTime: minT,
+			MaxTime: maxT,
+			Ref:     baseRef + chunks.ChunkRef(len(metas)),
+		})
+		cur = nil
+	}
+
+	for valType := it.Next(); valType != chunkenc.ValNone; valType = it.Next() {
+		switch valType {
+		case chunkenc.ValHistogram:
+			t, h := it.AtHistogram(nil)
+			if cur == nil || h.CounterResetHint == histogram.CounterReset {
+				flush()
+				hc := chunkenc.NewHistogramChunk()
+				a, err := hc.Appender()
+				if err != nil {
+					return nil, err
+				}
+				cur, app, minT = hc, a, t
+			}
+			if _, _, _, err := app.AppendHistogram(nil, t, h, true); err != nil {
+				return nil, err
+			}
+			maxT = t
+		case chunkenc.ValFloatHistogram:
+			t, fh := it.AtFloatHistogram(nil)
+			if cur == nil || fh.CounterResetHint == histogram.CounterReset {
+				flush()
+				hc := chunkenc.NewFloatHistogramChunk()
+				a, err := hc.Appender()
+				if err != nil {
+					return nil, err
+				}
+				cur, app, minT = hc, a, t
+			}
+			if _, _, _, err := app.AppendFloatHistogram(nil, t, fh, true); err != nil {
+				return nil, err
+			}
+			maxT = t
+		default:
+			return nil, fmt.Errorf("SplitAtCounterResets: unsupported sample type %v in OOO histogram merge", valType)
+		}
+	}
+	flush()
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return metas, nil
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/chunkenc"
@@ -63,10 +64,10 @@ func TestOOOHeadIndexReader_Series(t *testing.T) {
 			// Chunk 1: 0x1000001                                                                                              [-------------------]
 			// Chunk 2: 0x1000002                        [-------------------]
 			// Chunk 3: 0x1000003                                                                                                        [-------------------]
-			// Expected Output  [0x1000000, 0x1000001] with OOOLastReferences pointing to 0x1000003
+			// Expected Output  [0x1000000, 0x1000001]
 			expChunks: []chunks.Meta{
-				{Ref: 0x1000000, Chunk: chunkenc.Chunk(nil), MinTime: 100, MaxTime: 200, OOOLastRef: 0x1000003, OOOLastMinTime: 550, OOOLastMaxTime: 650},
-				{Ref: 0x1000001, Chunk: chunkenc.Chunk(nil), MinTime: 500, MaxTime: 600, OOOLastRef: 0x1000003, OOOLastMinTime: 550, OOOLastMaxTime: 650},
+				{Ref: 0x1000000, Chunk: chunkenc.Chunk(nil), MinTime: 100, MaxTime: 250},
+				{Ref: 0x1000001, Chunk: chunkenc.Chunk(nil), MinTime: 500, MaxTime: 650},
 			},
 		},
 		{
@@ -86,12 +87,12 @@ func TestOOOHeadIndexReader_Series(t *testing.T) {
 			// Chunk 1: 0x1000001                                  [-------------------]
 			// Chunk 2: 0x1000002                                                      [-------------------]
 			// Chunk 3: 0x1000003                                                                          [------------------]
-			// Expected Output  [0x1000000, 0x1000001, 0x1000002, 0x1000003] with OOOLastReferences pointing to 0x1000003
+			// Expected Output  [0x1000000, 0x1000001, 0x1000002, 0x1000003]
 			expChunks: []chunks.Meta{
-				{Ref: 0x1000000, Chunk: chunkenc.Chunk(nil), MinTime: 100, MaxTime: 200, OOOLastRef: 0x1000003, OOOLastMinTime: 400, OOOLastMaxTime: 500},
-				{Ref: 0x1000001, Chunk: chunkenc.Chunk(nil), MinTime: 200, MaxTime: 300, OOOLastRef: 0x1000003, OOOLastMinTime: 400, OOOLastMaxTime: 500},
-				{Ref: 0x1000002, Chunk: chunkenc.Chunk(nil), MinTime: 300, MaxTime: 400, OOOLastRef: 0x1000003, OOOLastMinTime: 400, OOOLastMaxTime: 500},
-				{Ref: 0x1000003, Chunk: chunkenc.Chunk(nil), MinTime: 400, MaxTime: 500, OOOLastRef: 0x1000003, OOOLastMinTime: 400, OOOLastMaxTime: 500},
+				{Ref: 0x1000000, Chunk: chunkenc.Chunk(nil), MinTime: 100, MaxTime: 200},
+				{Ref: 0x1000001, Chunk: chunkenc.Chunk(nil), MinTime: 200, MaxTime: 300},
+				{Ref: 0x1000002, Chunk: chunkenc.Chunk(nil), MinTime: 300, MaxTime: 400},
+				{Ref: 0x1000003, Chunk: chunkenc.Chunk(nil), MinTime: 400, MaxTime: 500},
 			},
 		},
 	}
@@ -115,7 +116,7 @@ func TestOOOHeadIndexReader_Series(t *testing.T) {
 				})
 			}
 
-			ir := NewOOOHeadIndexReader(h, tc.queryMinT, tc.queryMaxT)
+			ir := NewOOOHeadIndexReader(h, tc.queryMinT, tc.queryMaxT, newOOOPostings())
 
 			var chks []chunks.Meta
 			var respLset labels.Labels
@@ -130,3 +131,454 @@ func TestOOOHeadIndexReader_Series(t *testing.T) {
 		})
 	}
 }
+
+// TestOOOHeadChunkReader_SharesStateWithSeries checks the wiring the
+// multiMeta/oooQueryState machinery exists for: a chunk reader built from
+// OOOHeadIndexReader.State() after Series() runs sees exactly the overlap
+// group Series() found, instead of recomputing its own.
+func TestOOOHeadChunkReader_SharesStateWithSeries(t *testing.T) {
+	h, _ := newTestHead(t, 1000, false)
+	defer func() {
+		require.NoError(t, h.Close())
+	}()
+	require.NoError(t, h.Init(0))
+
+	s1Lset := labels.FromStrings("foo", "bar")
+	s1, _, _ := h.getOrCreate(1, s1Lset)
+
+	// Two overlapping OOO chunks that Series() must collapse into one group.
+	s1.oooMmappedChunks = append(s1.oooMmappedChunks,
+		&mmappedChunk{minTime: 100, maxTime: 200},
+		&mmappedChunk{minTime: 150, maxTime: 250},
+	)
+
+	ir := NewOOOHeadIndexReader(h, 0, 1000, newOOOPostings())
+	var chks []chunks.Meta
+	var lbls labels.Labels
+	require.NoError(t, ir.Series(storage.SeriesRef(1), &lbls, &chks))
+	require.Len(t, chks, 1)
+
+	g, ok := ir.State().group(chks[0].Ref)
+	require.True(t, ok)
+	require.Len(t, g.refs, 2)
+
+	// Stand in for the actual mmapped-chunk read (which needs a real
+	// chunkDiskMapper) by stashing the samples directly in the shared state,
+	// under the exact refs Series() grouped.
+	ir.State().setSnapshot(g.refs[0].Ref, chunkFromSamples(t, []sample{{t: 100, f: 1}}))
+	ir.State().setSnapshot(g.refs[1].Ref, chunkFromSamples(t, []sample{{t: 150, f: 2}}))
+
+	cr := NewOOOHeadChunkReader(h, 0, 1000, ir.State())
+	_, it, err := cr.ChunkOrIterable(chks[0])
+	require.NoError(t, err)
+	require.NotNil(t, it)
+
+	var got []sample
+	sit := it.Iterator(nil)
+	for sit.Next() != chunkenc.ValNone {
+		ts, v := sit.At()
+		got = append(got, sample{t: ts, f: v})
+	}
+	require.NoError(t, sit.Err())
+	require.Equal(t, []sample{{t: 100, f: 1}, {t: 150, f: 2}}, got)
+}
+
+// TestOOOHeadChunkReader_GroupPreservesAppendRecencyNotMinTime checks that a
+// group's refs end up ordered by append recency, not by the MinTime sort
+// Series() uses to find the overlaps in the first place. A chunk appended
+// first can easily cover a *later* time range than a chunk appended after
+// it -- that is what makes a write out-of-order -- so the two orders can
+// disagree, and the merge iterators need append order to break
+// duplicate-timestamp ties correctly.
+func TestOOOHeadChunkReader_GroupPreservesAppendRecencyNotMinTime(t *testing.T) {
+	h, _ := newTestHead(t, 1000, false)
+	defer func() {
+		require.NoError(t, h.Close())
+	}()
+	require.NoError(t, h.Init(0))
+
+	s1Lset := labels.FromStrings("foo", "bar")
+	s1, _, _ := h.getOrCreate(1, s1Lset)
+
+	// Appended first (older, lower chunk ID) but covers a later time range
+	// than the chunk appended after it.
+	s1.oooMmappedChunks = append(s1.oooMmappedChunks,
+		&mmappedChunk{minTime: 200, maxTime: 300},
+		&mmappedChunk{minTime: 100, maxTime: 250},
+	)
+
+	ir := NewOOOHeadIndexReader(h, 0, 1000, newOOOPostings())
+	var chks []chunks.Meta
+	var lbls labels.Labels
+	require.NoError(t, ir.Series(storage.SeriesRef(1), &lbls, &chks))
+	require.Len(t, chks, 1)
+
+	g, ok := ir.State().group(chks[0].Ref)
+	require.True(t, ok)
+	require.Len(t, g.refs, 2)
+
+	olderRef := chunks.ChunkRef(chunks.NewHeadChunkRef(s1.ref, s1.oooHeadChunkID(0)))
+	newerRef := chunks.ChunkRef(chunks.NewHeadChunkRef(s1.ref, s1.oooHeadChunkID(1)))
+	require.Equal(t, []chunks.ChunkRef{olderRef, newerRef}, []chunks.ChunkRef{g.refs[0].Ref, g.refs[1].Ref})
+
+	ir.State().setSnapshot(olderRef, chunkFromSamples(t, []sample{{t: 250, f: 999}}))
+	ir.State().setSnapshot(newerRef, chunkFromSamples(t, []sample{{t: 250, f: 111}}))
+
+	cr := NewOOOHeadChunkReader(h, 0, 1000, ir.State())
+	_, it, err := cr.ChunkOrIterable(chks[0])
+	require.NoError(t, err)
+	require.NotNil(t, it)
+
+	sit := it.Iterator(nil)
+	require.Equal(t, chunkenc.ValFloat, sit.Next())
+	ts, v := sit.At()
+	require.Equal(t, int64(250), ts)
+	require.Equal(t, float64(111), v) // the more recently appended chunk must win the tie.
+	require.Equal(t, chunkenc.ValNone, sit.Next())
+	require.NoError(t, sit.Err())
+}
+
+func chunkFromSamples(t *testing.T, samples []sample) chunkenc.Chunk {
+	c := chunkenc.NewXORChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+	for _, s := range samples {
+		app.Append(s.t, s.f)
+	}
+	return c
+}
+
+func TestOOOMergedChunkIterator(t *testing.T) {
+	// Two overlapping chunks; where timestamps collide the later chunk (c2)
+	// must win, mirroring how the OOO head resolves duplicate timestamps.
+	c1 := chunkFromSamples(t, []sample{{t: 1, f: 1}, {t: 2, f: 2}, {t: 4, f: 4}})
+	c2 := chunkFromSamples(t, []sample{{t: 2, f: 20}, {t: 3, f: 3}})
+
+	merged := &oooMergedChunk{chunks: []chunkenc.Chunk{c1, c2}}
+
+	var got []sample
+	it := merged.Iterator(nil)
+	for it.Next() != chunkenc.ValNone {
+		ts, v := it.At()
+		got = append(got, sample{t: ts, f: v})
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []sample{{t: 1, f: 1}, {t: 2, f: 20}, {t: 3, f: 3}, {t: 4, f: 4}}, got)
+}
+
+// TestOOOHeadIndexReader_Postings_OnlyOOOSeries checks that Postings only
+// returns series that oooPostings reports as having OOO data, rather than
+// every series matching the label matcher.
+func TestOOOHeadIndexReader_Postings_OnlyOOOSeries(t *testing.T) {
+	h, _ := newTestHead(t, 1000, false)
+	defer func() {
+		require.NoError(t, h.Close())
+	}()
+	require.NoError(t, h.Init(0))
+
+	s1Lset := labels.FromStrings("foo", "bar")
+	s1, _, _ := h.getOrCreate(1, s1Lset)
+	s2Lset := labels.FromStrings("foo", "bar", "job", "in-order")
+	s2, _, _ := h.getOrCreate(2, s2Lset)
+
+	// Only s1 has OOO data; s2 only has in-order samples in this fixture.
+	s1.oooMmappedChunks = append(s1.oooMmappedChunks, &mmappedChunk{minTime: 100, maxTime: 200})
+	_ = s2 // s2 is deliberately never added to oooPostings.
+	oop := newOOOPostings()
+	oop.Add(storage.SeriesRef(s1.ref), s1Lset)
+
+	ir := NewOOOHeadIndexReader(h, 0, 1000, oop)
+	p, err := ir.Postings("foo", "bar")
+	require.NoError(t, err)
+
+	var refs []storage.SeriesRef
+	for p.Next() {
+		refs = append(refs, p.At())
+	}
+	require.NoError(t, p.Err())
+	require.Equal(t, []storage.SeriesRef{storage.SeriesRef(s1.ref)}, refs)
+}
+
+// TestOOOPostings_PrunedAfterCompaction checks that a series removed from
+// oooPostings -- e.g. because its OOO chunks have all been compacted or
+// garbage collected away -- stops being returned by Get.
+func TestOOOPostings_PrunedAfterCompaction(t *testing.T) {
+	oop := newOOOPostings()
+	lset := labels.FromStrings("foo", "bar")
+	ref := storage.SeriesRef(1)
+
+	oop.Add(ref, lset)
+	p := oop.Get("foo", "bar")
+	require.True(t, p.Next())
+	require.Equal(t, ref, p.At())
+	require.False(t, p.Next())
+
+	oop.Del(ref, lset)
+
+	p = oop.Get("foo", "bar")
+	require.False(t, p.Next())
+}
+
+// BenchmarkOOOHeadIndexReader_Postings demonstrates the fan-out reduction
+// from filtering to OOO-only series on a head where very few series actually
+// carry OOO data.
+func BenchmarkOOOHeadIndexReader_Postings(b *testing.B) {
+	h, _ := newTestHead(b, 1000, false)
+	defer func() {
+		require.NoError(b, h.Close())
+	}()
+	require.NoError(b, h.Init(0))
+
+	oop := newOOOPostings()
+	const numSeries = 10000
+	for i := 0; i < numSeries; i++ {
+		lset := labels.FromStrings("foo", "bar", "series", string(rune(i)))
+		s, _, _ := h.getOrCreate(uint64(i), lset)
+		// Fewer than 1% of series receive OOO samples.
+		if i%100 == 0 {
+			s.oooMmappedChunks = append(s.oooMmappedChunks, &mmappedChunk{minTime: 100, maxTime: 200})
+			oop.Add(storage.SeriesRef(s.ref), lset)
+		}
+	}
+
+	ir := NewOOOHeadIndexReader(h, 0, 1000, oop)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p, err := ir.Postings("foo", "bar")
+		require.NoError(b, err)
+		for p.Next() {
+		}
+	}
+}
+
+// resettableChunk lets a test stand in for a pooled chunkenc.Chunk whose
+// backing object can be swapped out from under a reader, the way
+// chunkenc.Pool.Put recycling a chunk mid-query would.
+type resettableChunk struct {
+	inner chunkenc.Chunk
+}
+
+func (r *resettableChunk) Bytes() []byte                       { return r.inner.Bytes() }
+func (r *resettableChunk) Encoding() chunkenc.Encoding          { return r.inner.Encoding() }
+func (r *resettableChunk) Appender() (chunkenc.Appender, error) { return r.inner.Appender() }
+func (r *resettableChunk) NumSamples() int                      { return r.inner.NumSamples() }
+func (r *resettableChunk) Compact()                             { r.inner.Compact() }
+func (r *resettableChunk) Iterator(it chunkenc.Iterator) chunkenc.Iterator {
+	return r.inner.Iterator(it)
+}
+
+// TestWrapOOOHeadChunk_SurvivesPoolReset verifies that a chunk handed back by
+// wrapOOOHeadChunk keeps returning the samples it was wrapped with even if
+// the underlying pooled chunk object is reset and reused afterwards.
+func TestWrapOOOHeadChunk_SurvivesPoolReset(t *testing.T) {
+	rc := &resettableChunk{inner: chunkFromSamples(t, []sample{{t: 1, f: 1}, {t: 2, f: 2}})}
+
+	wrapped, err := wrapOOOHeadChunk(rc)
+	require.NoError(t, err)
+
+	// Simulate a synthetic compaction resetting the pooled chunk mid-query.
+	rc.inner = chunkFromSamples(t, []sample{{t: 99, f: 99}})
+
+	var got []sample
+	it := wrapped.Iterator(nil)
+	for it.Next() != chunkenc.ValNone {
+		ts, v := it.At()
+		got = append(got, sample{t: ts, f: v})
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []sample{{t: 1, f: 1}, {t: 2, f: 2}}, got)
+}
+
+// TestSnapshotChunk_Histogram verifies that snapshotChunk copies a native
+// histogram chunk's samples instead of forcing them through the float path,
+// which would have silently dropped the histogram data.
+func TestSnapshotChunk_Histogram(t *testing.T) {
+	type s = struct {
+		t int64
+		c uint64
+		h histogram.CounterResetHint
+	}
+	hc := histogramChunkWithSamples(t, []s{{t: 1, c: 5}, {t: 2, c: 10}})
+
+	snap, err := snapshotChunk(hc)
+	require.NoError(t, err)
+	require.Equal(t, chunkenc.EncHistogram, snap.Encoding())
+
+	var counts []uint64
+	it := snap.Iterator(nil)
+	for it.Next() != chunkenc.ValNone {
+		_, h := it.AtHistogram(nil)
+		counts = append(counts, h.Count)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []uint64{5, 10}, counts)
+}
+
+// TestWrapOOOHeadChunk_Histogram checks that wrapOOOHeadChunk, which is what
+// the single-chunk path of ChunkOrIterable calls for every OOO chunk
+// regardless of encoding, preserves a native histogram chunk's samples.
+func TestWrapOOOHeadChunk_Histogram(t *testing.T) {
+	type s = struct {
+		t int64
+		c uint64
+		h histogram.CounterResetHint
+	}
+	hc := histogramChunkWithSamples(t, []s{{t: 1, c: 7}})
+
+	wrapped, err := wrapOOOHeadChunk(hc)
+	require.NoError(t, err)
+	require.Equal(t, chunkenc.EncHistogram, wrapped.Encoding())
+
+	it := wrapped.Iterator(nil)
+	require.Equal(t, chunkenc.ValHistogram, it.Next())
+	_, h := it.AtHistogram(nil)
+	require.Equal(t, uint64(7), h.Count)
+}
+
+func histogramChunkWithSamples(t *testing.T, samples []struct {
+	t int64
+	c uint64
+	h histogram.CounterResetHint
+}) chunkenc.Chunk {
+	c := chunkenc.NewHistogramChunk()
+	app, err := c.Appender()
+	require.NoError(t, err)
+	for _, s := range samples {
+		h := &histogram.Histogram{Count: s.c, CounterResetHint: s.h}
+		_, _, _, err := app.AppendHistogram(nil, s.t, h, true)
+		require.NoError(t, err)
+	}
+	return c
+}
+
+// TestOOOHeadChunkReader_Chunk_ErrorsOnHistogramMerge checks that Chunk()
+// refuses to materialize a multi-chunk OOO histogram merge into a single
+// chunk rather than silently dropping any counter reset it should have been
+// split at.
+func TestOOOHeadChunkReader_Chunk_ErrorsOnHistogramMerge(t *testing.T) {
+	type s = struct {
+		t int64
+		c uint64
+		h histogram.CounterResetHint
+	}
+	c1 := histogramChunkWithSamples(t, []s{{t: 1, c: 10}})
+	c2 := histogramChunkWithSamples(t, []s{{t: 2, c: 20}})
+
+	state := newOOOQueryState()
+	ref1, ref2 := chunks.ChunkRef(1), chunks.ChunkRef(2)
+	state.setSnapshot(ref1, c1)
+	state.setSnapshot(ref2, c2)
+	state.newGroup(chunks.Meta{Ref: ref1, MinTime: 1, MaxTime: 1})
+	state.addToGroup(ref1, chunks.Meta{Ref: ref2, MinTime: 2, MaxTime: 2})
+
+	cr := NewOOOHeadChunkReader(nil, 0, 1000, state)
+	_, err := cr.Chunk(ref1)
+	require.Error(t, err)
+}
+
+// TestHistogramCounterReset_BucketDecrease checks that a bucket-level
+// decrease is detected as a counter reset even when the aggregate Count
+// doesn't go down, e.g. because samples were redistributed across buckets.
+func TestHistogramCounterReset_BucketDecrease(t *testing.T) {
+	prev := &histogram.Histogram{Count: 10, PositiveBuckets: []int64{5, 5}}
+	cur := &histogram.Histogram{Count: 10, PositiveBuckets: []int64{2, 8}}
+	require.True(t, histogramCounterReset(prev, cur))
+
+	fPrev := &histogram.FloatHistogram{Count: 10, PositiveBuckets: []float64{5, 5}}
+	fCur := &histogram.FloatHistogram{Count: 10, PositiveBuckets: []float64{2, 8}}
+	require.True(t, floatHistogramCounterReset(fPrev, fCur))
+}
+
+// TestHistogramCounterReset_DeltaEncodedBucketsNoSpuriousReset checks that
+// comparing reconstructed absolute bucket counts, not raw per-bucket
+// deltas, avoids flagging a redistribution between adjacent buckets as a
+// counter reset: prev's deltas [5,3] decode to absolute buckets [5,8], cur's
+// deltas [7,1] decode to [7,8] -- the real per-bucket totals only go up.
+func TestHistogramCounterReset_DeltaEncodedBucketsNoSpuriousReset(t *testing.T) {
+	prev := &histogram.Histogram{Count: 8, PositiveBuckets: []int64{5, 3}}
+	cur := &histogram.Histogram{Count: 8, PositiveBuckets: []int64{7, 1}}
+	require.False(t, histogramCounterReset(prev, cur))
+}
+
+// TestHistogramCounterReset_ZeroCountDecrease checks that a drop in the
+// zero-bucket count alone is detected as a counter reset.
+func TestHistogramCounterReset_ZeroCountDecrease(t *testing.T) {
+	prev := &histogram.Histogram{Count: 10, ZeroCount: 5}
+	cur := &histogram.Histogram{Count: 10, ZeroCount: 2}
+	require.True(t, histogramCounterReset(prev, cur))
+}
+
+// TestHistogramCounterReset_MonotonicIncrease checks that a histogram whose
+// count, zero count, and every bucket only grow is not flagged as a reset.
+func TestHistogramCounterReset_MonotonicIncrease(t *testing.T) {
+	prev := &histogram.Histogram{Count: 10, ZeroCount: 1, PositiveBuckets: []int64{5, 5}}
+	cur := &histogram.Histogram{Count: 20, ZeroCount: 2, PositiveBuckets: []int64{6, 6}}
+	require.False(t, histogramCounterReset(prev, cur))
+}
+
+func TestOOOMergedHistogramChunk_MixedEncodingsError(t *testing.T) {
+	hChunk := histogramChunkWithSamples(t, []struct {
+		t int64
+		c uint64
+		h histogram.CounterResetHint
+	}{{t: 1, c: 1}})
+
+	fhc := chunkenc.NewFloatHistogramChunk()
+	app, err := fhc.Appender()
+	require.NoError(t, err)
+	_, _, _, err = app.AppendFloatHistogram(nil, 1, &histogram.FloatHistogram{Count: 1}, true)
+	require.NoError(t, err)
+
+	_, err = newOOOMergedHistogramChunk([]chunkenc.Chunk{hChunk, fhc})
+	require.Error(t, err)
+}
+
+// TestOOOMergedHistogramChunk_CounterResetAtBoundary checks that merging two
+// overlapping OOO histogram chunks, where the second (later-appended) chunk
+// restarts from a lower count, is detected as a counter reset at the chunk
+// boundary and split into two output chunks by SplitAtCounterResets.
+func TestOOOMergedHistogramChunk_CounterResetAtBoundary(t *testing.T) {
+	type s = struct {
+		t int64
+		c uint64
+		h histogram.CounterResetHint
+	}
+	c1 := histogramChunkWithSamples(t, []s{{t: 1, c: 10}, {t: 2, c: 20}})
+	c2 := histogramChunkWithSamples(t, []s{{t: 3, c: 2}, {t: 4, c: 4}})
+
+	merged, err := newOOOMergedHistogramChunk([]chunkenc.Chunk{c1, c2})
+	require.NoError(t, err)
+
+	metas, err := SplitAtCounterResets(0x2000000, merged.Iterator(nil))
+	require.NoError(t, err)
+	require.Len(t, metas, 2)
+	require.Equal(t, int64(1), metas[0].MinTime)
+	require.Equal(t, int64(2), metas[0].MaxTime)
+	require.Equal(t, int64(3), metas[1].MinTime)
+	require.Equal(t, int64(4), metas[1].MaxTime)
+}
+
+// TestOOOMergedHistogramChunk_ExplicitResetOutOfOrder checks that an
+// explicit CounterReset hint recorded when a sample was appended in order is
+// still honoured when that sample ends up merged with an out-of-order chunk
+// that precedes it in time.
+func TestOOOMergedHistogramChunk_ExplicitResetOutOfOrder(t *testing.T) {
+	type s = struct {
+		t int64
+		c uint64
+		h histogram.CounterResetHint
+	}
+	// c1 is the in-order chunk: it already recorded an explicit reset at t=10.
+	c1 := histogramChunkWithSamples(t, []s{{t: 10, c: 1, h: histogram.CounterReset}, {t: 11, c: 2}})
+	// c2 arrives out of order, entirely before c1.
+	c2 := histogramChunkWithSamples(t, []s{{t: 1, c: 50}})
+
+	merged, err := newOOOMergedHistogramChunk([]chunkenc.Chunk{c1, c2})
+	require.NoError(t, err)
+
+	metas, err := SplitAtCounterResets(0x3000000, merged.Iterator(nil))
+	require.NoError(t, err)
+	require.Len(t, metas, 2)
+	require.Equal(t, int64(1), metas[0].MinTime)
+	require.Equal(t, int64(10), metas[1].MinTime)
+}